@@ -24,6 +24,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"math"
+	"sort"
 
 	dpb "github.com/golang/protobuf/protoc-gen-go/descriptor"
 	"github.com/jhump/protoreflect/desc"
@@ -34,17 +35,28 @@ import (
 )
 
 type encoder struct {
-	stream             encoding.OStream
-	schema             *desc.MessageDescriptor
-	hasWrittenFirstTSZ bool
-	lastEncoded        *dynamic.Message
-	tszFields          []tszFieldState
+	stream      encoding.OStream
+	schema      *desc.MessageDescriptor
+	lastEncoded *dynamic.Message
+	tszFields   []tszFieldState
 }
 
 type tszFieldState struct {
-	fieldNum      int
-	prevXOR       uint64
-	prevFloatBits uint64
+	// fieldPath is the sequence of field numbers (starting from the root
+	// message) that leads to this field, so that fields nested inside
+	// TYPE_MESSAGE fields can be located without flattening the schema.
+	fieldPath []int32
+	fieldType dpb.FieldDescriptorProto_Type
+	prevXOR   uint64
+	prevBits  uint64
+	// hasPrev tracks, per field, whether prevXOR/prevBits hold a real
+	// observed value yet. It's per-field rather than a single encoder/
+	// iterator-wide flag because a field nested inside an optional
+	// TYPE_MESSAGE can come and go across messages: when its enclosing
+	// message isn't set on a given message, the field is skipped entirely,
+	// and if it reappears later it needs to be written/read as a fresh
+	// absolute value rather than XOR-delta'd against stale state.
+	hasPrev bool
 }
 
 // NewEncoder creates a new encoder.
@@ -66,70 +78,470 @@ func NewEncoder(
 }
 
 func (enc *encoder) Encode(m *dynamic.Message) error {
-	enc.encodeTSZValues(m)
-	enc.encodeProtoValues(m)
+	if err := enc.encodeTSZValues(m); err != nil {
+		return err
+	}
+	if err := enc.encodeProtoValues(m); err != nil {
+		return err
+	}
 	enc.lastEncoded = m
 	return nil
 }
 
 func (enc *encoder) encodeTSZValues(m *dynamic.Message) error {
-	for i, tszField := range enc.tszFields {
-		iVal, err := m.TryGetFieldByNumber(tszField.fieldNum)
+	for i := range enc.tszFields {
+		tszField := &enc.tszFields[i]
+		leafNum := int(tszField.fieldPath[len(tszField.fieldPath)-1])
+		parentPath := tszField.fieldPath[:len(tszField.fieldPath)-1]
+
+		var parent *dynamic.Message
+		if len(parentPath) == 0 {
+			parent = m
+		} else {
+			var ok bool
+			var err error
+			parent, ok, err = navigateToNestedMessage(m, parentPath)
+			if err != nil {
+				return fmt.Errorf(
+					"proto encoder error trying to navigate to field path %v: %v",
+					tszField.fieldPath, err)
+			}
+			if !ok {
+				// The message(s) that would contain this field aren't set on
+				// this message (common in proto3, where sub-messages are
+				// routinely nil), so there's no value to encode. Record that
+				// so the decoder knows to skip it too, and reset the field's
+				// delta state so it's written as an absolute value rather
+				// than an XOR delta against stale state if it reappears.
+				enc.stream.WriteBit(0)
+				tszField.hasPrev = false
+				continue
+			}
+			enc.stream.WriteBit(1)
+		}
+
+		fieldType, err := tszFieldType(parent, leafNum)
 		if err != nil {
+			return err
+		}
+		if fieldType != tszField.fieldType {
 			return fmt.Errorf(
-				"proto encoder error trying to get field number: %d",
-				tszField.fieldNum)
+				"proto encoder error: field path %v changed type from %v to %v between messages",
+				tszField.fieldPath, tszField.fieldType, fieldType)
 		}
 
-		var val float64
-		if typedVal, ok := iVal.(float64); ok {
-			val = typedVal
-		} else {
-			// TODO: Better error handling here
-			val = float64(iVal.(float32))
+		iVal, err := parent.TryGetFieldByNumber(leafNum)
+		if err != nil {
+			return fmt.Errorf(
+				"proto encoder error trying to get field path: %v", tszField.fieldPath)
 		}
 
-		if !enc.hasWrittenFirstTSZ {
-			enc.writeFirstTSZValue(i, val)
+		bits, err := tszFieldBits(fieldType, iVal)
+		if err != nil {
+			return err
+		}
+
+		if !tszField.hasPrev {
+			enc.writeFirstTSZValue(i, bits)
+			tszField.hasPrev = true
 		} else {
-			enc.writeNextTSZValue(i, val)
+			enc.writeNextTSZValue(i, bits)
 		}
 
 		// Remove the field from the message so we don't include it
 		// in the proto marshal.
-		m.ClearFieldByNumber(tszField.fieldNum)
+		parent.ClearFieldByNumber(leafNum)
 	}
-	enc.hasWrittenFirstTSZ = true
 
 	return nil
 }
 
-func (enc *encoder) encodeProtoValues(m *dynamic.Message) error {
-	var changedFields []int
-	if enc.lastEncoded != nil {
-		// Clone before mutating.
-		orig := m
-		m = dynamic.NewMessage(enc.schema)
-		m.MergeFrom(orig)
-		// TODO: Clear everything from message that is not in schema.
-		// For everything that remains, compare with previous message.
-		//    If same, remove.
-		//    else, leave it in
-		schemaFields := enc.schema.GetFields()
-		// TODO: Need to make sure there are no unknown fields
-		for _, field := range schemaFields {
-			prevVal := enc.lastEncoded.GetFieldByNumber(int(field.GetNumber()))
-			curVal := m.GetFieldByNumber(int(field.GetNumber()))
-			if fieldsEqual(curVal, prevVal) {
-				// Clear fields that haven't changed.
-				m.ClearFieldByNumber(int(field.GetNumber()))
-			} else {
-				changedFields = append(changedFields, int(field.GetNumber()))
+// navigateToNestedMessage walks m through the given path of nested
+// TYPE_MESSAGE field numbers and returns the message the path leads to. An
+// empty path returns m itself. ok is false (with a nil error) if some
+// message along the path isn't set, which in proto3 is an expected
+// condition (optional sub-messages are routinely absent) rather than an
+// error.
+func navigateToNestedMessage(m *dynamic.Message, path []int32) (res *dynamic.Message, ok bool, err error) {
+	cur := m
+	for _, fieldNum := range path {
+		iVal, err := cur.TryGetFieldByNumber(int(fieldNum))
+		if err != nil {
+			return nil, false, err
+		}
+
+		nested, ok := iVal.(*dynamic.Message)
+		if !ok || nested == nil {
+			return nil, false, nil
+		}
+		cur = nested
+	}
+
+	return cur, true, nil
+}
+
+// tszFieldType returns the wire type of the given field number on m's
+// schema so that it can be compared against the type the field had when
+// the encoder first observed it.
+func tszFieldType(m *dynamic.Message, fieldNum int) (dpb.FieldDescriptorProto_Type, error) {
+	field := m.GetMessageDescriptor().FindFieldByNumber(int32(fieldNum))
+	if field == nil {
+		return 0, fmt.Errorf(
+			"proto encoder error: field number %d not present in schema", fieldNum)
+	}
+	return field.GetType(), nil
+}
+
+// tszFieldBits reinterprets iVal (the dynamic.Message representation of a
+// TSZ-eligible field) as the uint64 that should be fed through the XOR
+// delta path. Floats are bit-cast directly; integers are sign-extended
+// to 64-bits (where applicable) and then bit-cast so that negative
+// values round-trip correctly.
+func tszFieldBits(fieldType dpb.FieldDescriptorProto_Type, iVal interface{}) (uint64, error) {
+	switch fieldType {
+	case dpb.FieldDescriptorProto_TYPE_DOUBLE:
+		return math.Float64bits(iVal.(float64)), nil
+	case dpb.FieldDescriptorProto_TYPE_FLOAT:
+		return math.Float64bits(float64(iVal.(float32))), nil
+	case dpb.FieldDescriptorProto_TYPE_INT64,
+		dpb.FieldDescriptorProto_TYPE_SINT64,
+		dpb.FieldDescriptorProto_TYPE_SFIXED64:
+		return uint64(iVal.(int64)), nil
+	case dpb.FieldDescriptorProto_TYPE_INT32,
+		dpb.FieldDescriptorProto_TYPE_SINT32,
+		dpb.FieldDescriptorProto_TYPE_SFIXED32:
+		return uint64(int64(iVal.(int32))), nil
+	case dpb.FieldDescriptorProto_TYPE_UINT64, dpb.FieldDescriptorProto_TYPE_FIXED64:
+		return iVal.(uint64), nil
+	case dpb.FieldDescriptorProto_TYPE_UINT32, dpb.FieldDescriptorProto_TYPE_FIXED32:
+		return uint64(iVal.(uint32)), nil
+	default:
+		return 0, fmt.Errorf(
+			"proto encoder error: field type %v is not TSZ-eligible", fieldType)
+	}
+}
+
+// changeSet describes which fields of a message changed relative to the
+// previously encoded message. Fields that are themselves nested messages
+// carry their own changeSet so that a decoder can walk the same tree
+// without needing the unmarshaled value of fields that didn't change.
+// Fields that are repeated or map fields carry a write func instead,
+// because they're encoded as out-of-band index/key deltas rather than
+// being left in the marshaled remainder.
+type changeSet struct {
+	fields []fieldChange
+}
+
+type fieldChange struct {
+	num             int
+	isNestedMessage bool
+	nested          *changeSet
+	write           func(enc *encoder) error
+}
+
+// diffMessage compares m against prev (nil means there is no previous
+// message, i.e. every field is new) and mutates m in place so that only
+// the fields that changed remain in it: nested messages are recursively
+// pruned to just their own changed fields, and repeated/map fields are
+// always cleared since diffMessage reports their deltas out-of-band via
+// fieldChange.write instead of leaving them to be remarshaled whole.
+func diffMessage(
+	m, prev *dynamic.Message,
+	schema *desc.MessageDescriptor,
+) (*changeSet, error) {
+	cs := &changeSet{}
+	for _, field := range schema.GetFields() {
+		num := int(field.GetNumber())
+
+		if field.IsMap() {
+			changed, write, err := diffMapField(m, prev, field, num)
+			if err != nil {
+				return nil, err
+			}
+			m.ClearFieldByNumber(num)
+			if changed {
+				cs.fields = append(cs.fields, fieldChange{num: num, write: write})
+			}
+			continue
+		}
+
+		if field.IsRepeated() {
+			changed, write, err := diffRepeatedField(m, prev, field, num)
+			if err != nil {
+				return nil, err
+			}
+			m.ClearFieldByNumber(num)
+			if changed {
+				cs.fields = append(cs.fields, fieldChange{num: num, write: write})
+			}
+			continue
+		}
+
+		if field.GetType() == dpb.FieldDescriptorProto_TYPE_MESSAGE {
+			curNested, _ := m.GetFieldByNumber(num).(*dynamic.Message)
+			if curNested == nil {
+				m.ClearFieldByNumber(num)
+				continue
+			}
+
+			var prevNested *dynamic.Message
+			if prev != nil {
+				prevNested, _ = prev.GetFieldByNumber(num).(*dynamic.Message)
+			}
+			if prevNested == nil {
+				// Newly-populated nested message: every leaf within it is new,
+				// so leave it in the marshaled remainder whole rather than
+				// recursing into a child changeSet.
+				cs.fields = append(cs.fields, fieldChange{num: num, isNestedMessage: true})
+				continue
+			}
+
+			nestedCS, err := diffMessage(curNested, prevNested, field.GetMessageType())
+			if err != nil {
+				return nil, err
+			}
+			if len(nestedCS.fields) == 0 {
+				m.ClearFieldByNumber(num)
+				continue
+			}
+			cs.fields = append(cs.fields, fieldChange{num: num, isNestedMessage: true, nested: nestedCS})
+			continue
+		}
+
+		var prevVal interface{}
+		if prev != nil {
+			prevVal = prev.GetFieldByNumber(num)
+		}
+		curVal := m.GetFieldByNumber(num)
+		if prev != nil && fieldsEqual(curVal, prevVal) {
+			m.ClearFieldByNumber(num)
+		} else {
+			cs.fields = append(cs.fields, fieldChange{num: num})
+		}
+	}
+
+	return cs, nil
+}
+
+// diffRepeatedField compares a non-map repeated field element-wise and,
+// if anything changed, returns a write func that emits the new length
+// followed by a varint-prefixed list of (index, newValue) deltas so that
+// only the elements that actually changed need to be re-transmitted.
+func diffRepeatedField(
+	m, prev *dynamic.Message,
+	field *desc.FieldDescriptor,
+	num int,
+) (bool, func(enc *encoder) error, error) {
+	curLen := m.FieldLength(field)
+	prevLen := 0
+	if prev != nil {
+		prevLen = prev.FieldLength(field)
+	}
+
+	maxLen := curLen
+	if prevLen > maxLen {
+		maxLen = prevLen
+	}
+
+	isMessage := field.GetType() == dpb.FieldDescriptorProto_TYPE_MESSAGE
+
+	type repeatedElemChange struct {
+		index int
+		val   interface{}
+	}
+	var changes []repeatedElemChange
+	for i := 0; i < maxLen; i++ {
+		if i >= curLen {
+			// Trailing element dropped by a shrink: curLen (written below)
+			// already communicates the truncation, and there's no current
+			// value to emit a delta for.
+			continue
+		}
+
+		curVal := m.GetRepeatedFieldByNumber(num, i)
+
+		var prevVal interface{}
+		if i < prevLen {
+			prevVal = prev.GetRepeatedFieldByNumber(num, i)
+		}
+		if i >= prevLen || !fieldsEqual(curVal, prevVal) {
+			changes = append(changes, repeatedElemChange{index: i, val: curVal})
+		}
+	}
+
+	if len(changes) == 0 && curLen == prevLen {
+		return false, nil, nil
+	}
+
+	write := func(enc *encoder) error {
+		enc.writeVarInt(uint64(curLen))
+		enc.writeVarInt(uint64(len(changes)))
+		for _, c := range changes {
+			enc.writeVarInt(uint64(c.index))
+			if isMessage {
+				if err := enc.writeMessageValue(c.val); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := enc.writeScalarValue(field.GetType(), c.val); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return true, write, nil
+}
+
+// diffMapField compares a map field key-by-key. A map field is
+// represented by the dynamic message library as a map[interface{}]interface{}
+// keyed by the unwrapped map-entry key. If anything changed, it returns a
+// write func that emits the removed keys followed by the added/updated
+// (key, newValue) pairs.
+func diffMapField(
+	m, prev *dynamic.Message,
+	field *desc.FieldDescriptor,
+	num int,
+) (bool, func(enc *encoder) error, error) {
+	curMap, _ := m.GetFieldByNumber(num).(map[interface{}]interface{})
+	var prevMap map[interface{}]interface{}
+	if prev != nil {
+		prevMap, _ = prev.GetFieldByNumber(num).(map[interface{}]interface{})
+	}
+
+	mapEntry := field.GetMessageType()
+	keyField := mapEntry.FindFieldByNumber(1)
+	valueField := mapEntry.FindFieldByNumber(2)
+	isMessage := valueField.GetType() == dpb.FieldDescriptorProto_TYPE_MESSAGE
+
+	type mapUpsert struct {
+		key interface{}
+		val interface{}
+	}
+	var upserts []mapUpsert
+	for k, v := range curMap {
+		prevVal, ok := prevMap[k]
+		if !ok || !fieldsEqual(v, prevVal) {
+			upserts = append(upserts, mapUpsert{key: k, val: v})
+		}
+	}
+
+	var removed []interface{}
+	for k := range prevMap {
+		if _, ok := curMap[k]; !ok {
+			removed = append(removed, k)
+		}
+	}
+
+	if len(upserts) == 0 && len(removed) == 0 {
+		return false, nil, nil
+	}
+
+	write := func(enc *encoder) error {
+		enc.writeVarInt(uint64(len(removed)))
+		for _, k := range removed {
+			if err := enc.writeScalarValue(keyField.GetType(), k); err != nil {
+				return err
+			}
+		}
+
+		enc.writeVarInt(uint64(len(upserts)))
+		for _, u := range upserts {
+			if err := enc.writeScalarValue(keyField.GetType(), u.key); err != nil {
+				return err
+			}
+			if isMessage {
+				if err := enc.writeMessageValue(u.val); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := enc.writeScalarValue(valueField.GetType(), u.val); err != nil {
+				return err
 			}
 		}
+		return nil
+	}
+
+	return true, write, nil
+}
+
+// writeMessageValue marshals a nested message value (a repeated or map
+// field element) whole and writes it as a varint-prefixed byte string.
+// Unlike top-level nested messages, repeated/map elements aren't diffed
+// field-by-field since doing so would require tracking per-index/per-key
+// TSZ-like state, which isn't worth the complexity for what are usually
+// small, infrequently-changing elements.
+func (enc *encoder) writeMessageValue(val interface{}) error {
+	msg, ok := val.(*dynamic.Message)
+	if !ok || msg == nil {
+		enc.writeVarInt(0)
+		return nil
+	}
+
+	marshaled, err := msg.Marshal()
+	if err != nil {
+		return fmt.Errorf("proto encoder error trying to marshal nested message value: %v", err)
+	}
+
+	enc.writeVarInt(uint64(len(marshaled)))
+	enc.stream.WriteBytes(marshaled)
+	return nil
+}
+
+// writeScalarValue writes a single non-message field value using a
+// type-appropriate fixed-width or varint encoding.
+func (enc *encoder) writeScalarValue(fieldType dpb.FieldDescriptorProto_Type, val interface{}) error {
+	switch fieldType {
+	case dpb.FieldDescriptorProto_TYPE_DOUBLE:
+		enc.stream.WriteBits(math.Float64bits(val.(float64)), 64)
+	case dpb.FieldDescriptorProto_TYPE_FLOAT:
+		enc.stream.WriteBits(uint64(math.Float32bits(val.(float32))), 32)
+	case dpb.FieldDescriptorProto_TYPE_BOOL:
+		if val.(bool) {
+			enc.stream.WriteBit(1)
+		} else {
+			enc.stream.WriteBit(0)
+		}
+	case dpb.FieldDescriptorProto_TYPE_STRING:
+		b := []byte(val.(string))
+		enc.writeVarInt(uint64(len(b)))
+		enc.stream.WriteBytes(b)
+	case dpb.FieldDescriptorProto_TYPE_BYTES:
+		b := val.([]byte)
+		enc.writeVarInt(uint64(len(b)))
+		enc.stream.WriteBytes(b)
+	case dpb.FieldDescriptorProto_TYPE_INT64,
+		dpb.FieldDescriptorProto_TYPE_SINT64,
+		dpb.FieldDescriptorProto_TYPE_SFIXED64:
+		enc.writeVarInt(uint64(val.(int64)))
+	case dpb.FieldDescriptorProto_TYPE_INT32,
+		dpb.FieldDescriptorProto_TYPE_SINT32,
+		dpb.FieldDescriptorProto_TYPE_SFIXED32:
+		enc.writeVarInt(uint64(uint32(val.(int32))))
+	case dpb.FieldDescriptorProto_TYPE_UINT64, dpb.FieldDescriptorProto_TYPE_FIXED64:
+		enc.writeVarInt(val.(uint64))
+	case dpb.FieldDescriptorProto_TYPE_UINT32, dpb.FieldDescriptorProto_TYPE_FIXED32:
+		enc.writeVarInt(uint64(val.(uint32)))
+	default:
+		return fmt.Errorf("proto encoder error: unsupported scalar field type: %v", fieldType)
+	}
+	return nil
+}
+
+func (enc *encoder) encodeProtoValues(m *dynamic.Message) error {
+	// Clone before mutating.
+	orig := m
+	m = dynamic.NewMessage(enc.schema)
+	m.MergeFrom(orig)
+
+	cs, err := diffMessage(m, enc.lastEncoded, enc.schema)
+	if err != nil {
+		return err
 	}
 
-	if len(changedFields) == 0 && enc.lastEncoded != nil {
+	if len(cs.fields) == 0 && enc.lastEncoded != nil {
 		// Only want to skip encoding if nothing has changed AND we've already
 		// encoded the first message.
 		enc.stream.WriteBit(0)
@@ -142,7 +554,9 @@ func (enc *encoder) encodeProtoValues(m *dynamic.Message) error {
 	}
 
 	enc.stream.WriteBit(1)
-	enc.writeBitset(changedFields...)
+	if err := enc.writeChangeSet(cs); err != nil {
+		return err
+	}
 	enc.writeVarInt(uint64(len(marshaled)))
 	enc.stream.WriteBytes(marshaled)
 
@@ -158,21 +572,57 @@ func (enc *encoder) fieldsContains(fieldNum int32, fields []*desc.FieldDescripto
 	return false
 }
 
-func (enc *encoder) writeFirstTSZValue(i int, v float64) {
-	fb := math.Float64bits(v)
-	enc.stream.WriteBits(fb, 64)
-	enc.tszFields[i].prevFloatBits = fb
-	enc.tszFields[i].prevXOR = fb
+func (enc *encoder) writeFirstTSZValue(i int, bits uint64) {
+	enc.stream.WriteBits(bits, 64)
+	enc.tszFields[i].prevBits = bits
+	enc.tszFields[i].prevXOR = bits
 }
 
-func (enc *encoder) writeNextTSZValue(i int, next float64) {
-	curFloatBits := math.Float64bits(next)
-	curXOR := enc.tszFields[i].prevFloatBits ^ curFloatBits
+func (enc *encoder) writeNextTSZValue(i int, curBits uint64) {
+	curXOR := enc.tszFields[i].prevBits ^ curBits
 	m3tsz.WriteXOR(enc.stream, enc.tszFields[i].prevXOR, curXOR)
-	enc.tszFields[i].prevFloatBits = curFloatBits
+	enc.tszFields[i].prevBits = curBits
 	enc.tszFields[i].prevXOR = curXOR
 }
 
+// writeChangeSet emits a hierarchical change descriptor: a bitset of the
+// field numbers that changed at this level, followed (for each changed
+// field, in ascending field-number order to match how readBitset replays
+// them) by a presence bit plus nested bitset if it's a nested message, or
+// its out-of-band repeated/map delta payload if it's one of those.
+// Decoders walk the exact same tree via readChangeSet.
+func (enc *encoder) writeChangeSet(cs *changeSet) error {
+	sorted := make([]fieldChange, len(cs.fields))
+	copy(sorted, cs.fields)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].num < sorted[j].num })
+
+	nums := make([]int, 0, len(sorted))
+	for _, f := range sorted {
+		nums = append(nums, f.num)
+	}
+	enc.writeBitset(nums...)
+
+	for _, f := range sorted {
+		if f.isNestedMessage {
+			if f.nested != nil {
+				enc.stream.WriteBit(1)
+				if err := enc.writeChangeSet(f.nested); err != nil {
+					return err
+				}
+			} else {
+				enc.stream.WriteBit(0)
+			}
+		}
+		if f.write != nil {
+			if err := f.write(enc); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
 func (enc *encoder) writeBitset(values ...int) {
 	var max int
 	for _, v := range values {
@@ -207,17 +657,18 @@ func (enc *encoder) writeBitset(values ...int) {
 
 func (enc *encoder) writeVarInt(x uint64) {
 	// TODO: Reuse this
-	buf := make([]byte, 8)
+	buf := make([]byte, binary.MaxVarintLen64)
 	numBytes := binary.PutUvarint(buf, x)
 	buf = buf[:numBytes]
 	enc.stream.WriteBytes(buf)
 }
 
-// TODO(rartoul): SetTSZFields and numTSZFields are naive in that they don't handle
-// repeated or nested messages / maps.
-// TODO(rartoul): Should handle integers as TSZ as well, can just do XOR on the regular
-// bits after converting to uint64. Just need to check type on encode/iterate to determine
-// how to interpret bits.
+// tszFields walks schema (recursing into nested, non-repeated TYPE_MESSAGE
+// fields) to build the flat list of TSZ-eligible fields, identified by
+// their path from the root message. Repeated and map fields, including
+// any TSZ-eligible fields nested within them, are handled separately by
+// diffRepeatedField/diffMapField since tracking per-element/per-key XOR
+// state isn't worth the complexity.
 func tszFields(s []tszFieldState, schema *desc.MessageDescriptor) []tszFieldState {
 	numTSZFields := numTSZFields(schema)
 	if cap(s) >= numTSZFields {
@@ -226,13 +677,27 @@ func tszFields(s []tszFieldState, schema *desc.MessageDescriptor) []tszFieldStat
 		s = make([]tszFieldState, 0, numTSZFields)
 	}
 
-	fields := schema.GetFields()
-	for _, field := range fields {
+	return appendTSZFields(s, nil, schema)
+}
+
+func appendTSZFields(s []tszFieldState, path []int32, schema *desc.MessageDescriptor) []tszFieldState {
+	for _, field := range schema.GetFields() {
+		if field.IsRepeated() || field.IsMap() {
+			continue
+		}
+
+		fieldPath := append(append([]int32{}, path...), field.GetNumber())
+
 		fieldType := field.GetType()
-		if fieldType == dpb.FieldDescriptorProto_TYPE_DOUBLE ||
-			fieldType == dpb.FieldDescriptorProto_TYPE_FLOAT {
+		if fieldType == dpb.FieldDescriptorProto_TYPE_MESSAGE {
+			s = appendTSZFields(s, fieldPath, field.GetMessageType())
+			continue
+		}
+
+		if isTSZFieldType(fieldType) {
 			s = append(s, tszFieldState{
-				fieldNum: int(field.GetNumber()),
+				fieldPath: fieldPath,
+				fieldType: fieldType,
 			})
 		}
 	}
@@ -241,18 +706,47 @@ func tszFields(s []tszFieldState, schema *desc.MessageDescriptor) []tszFieldStat
 }
 
 func numTSZFields(schema *desc.MessageDescriptor) int {
-	var (
-		fields       = schema.GetFields()
-		numTSZFields = 0
-	)
+	var count int
 
-	for _, field := range fields {
-		fieldType := field.GetType()
-		if fieldType == dpb.FieldDescriptorProto_TYPE_DOUBLE ||
-			fieldType == dpb.FieldDescriptorProto_TYPE_FLOAT {
-			numTSZFields++
+	for _, field := range schema.GetFields() {
+		if field.IsRepeated() || field.IsMap() {
+			continue
+		}
+
+		if field.GetType() == dpb.FieldDescriptorProto_TYPE_MESSAGE {
+			count += numTSZFields(field.GetMessageType())
+			continue
+		}
+
+		if isTSZFieldType(field.GetType()) {
+			count++
 		}
 	}
 
-	return numTSZFields
-}
\ No newline at end of file
+	return count
+}
+
+// isTSZFieldType returns true if values of the given wire type should be
+// XOR-compressed as part of the TSZ stream rather than being left in the
+// marshaled protobuf remainder. Floats are reinterpreted as their IEEE-754
+// bits; integers are reinterpreted (with sign-extension where applicable)
+// as their two's complement bits.
+func isTSZFieldType(t dpb.FieldDescriptorProto_Type) bool {
+	switch t {
+	case dpb.FieldDescriptorProto_TYPE_DOUBLE,
+		dpb.FieldDescriptorProto_TYPE_FLOAT,
+		dpb.FieldDescriptorProto_TYPE_INT32,
+		dpb.FieldDescriptorProto_TYPE_INT64,
+		dpb.FieldDescriptorProto_TYPE_UINT32,
+		dpb.FieldDescriptorProto_TYPE_UINT64,
+		dpb.FieldDescriptorProto_TYPE_SINT32,
+		dpb.FieldDescriptorProto_TYPE_SINT64,
+		dpb.FieldDescriptorProto_TYPE_FIXED32,
+		dpb.FieldDescriptorProto_TYPE_FIXED64,
+		dpb.FieldDescriptorProto_TYPE_SFIXED32,
+		dpb.FieldDescriptorProto_TYPE_SFIXED64:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package proto
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+	"github.com/m3db/m3/src/dbnode/encoding"
+	"github.com/m3db/m3x/checked"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestEncoder(t *testing.T, schema *desc.MessageDescriptor) *encoder {
+	enc, err := NewEncoder(checked.NewBytes(nil, nil), schema, encoding.NewOptions())
+	require.NoError(t, err)
+	return enc
+}
+
+// buildMessage constructs a *dynamic.Message against schema, optionally
+// setting the nested sub-message, the repeated tags, and the attributes
+// map, so test cases can exercise every kind of field the schema has
+// without each writing out the same boilerplate.
+func buildMessage(
+	t *testing.T,
+	schema *desc.MessageDescriptor,
+	id int64,
+	value float64,
+	innerSet bool,
+	inner float32,
+	tags []string,
+	attrs map[string]string,
+) *dynamic.Message {
+	m := dynamic.NewMessage(schema)
+	require.NoError(t, m.TrySetFieldByName("id", id))
+	require.NoError(t, m.TrySetFieldByName("value", value))
+
+	if innerSet {
+		nested := dynamic.NewMessage(schema.FindFieldByName("nested").GetMessageType())
+		require.NoError(t, nested.TrySetFieldByName("inner", inner))
+		require.NoError(t, m.TrySetFieldByName("nested", nested))
+	}
+
+	for _, tag := range tags {
+		require.NoError(t, m.TryAddRepeatedFieldByName("tags", tag))
+	}
+
+	for k, v := range attrs {
+		require.NoError(t, m.TryPutMapFieldByName("attributes", k, v))
+	}
+
+	return m
+}
+
+// TestEncodeIterateRoundTrip feeds a sequence of messages through an
+// encoder and verifies that an iterator reading the resulting stream
+// reconstructs the exact same sequence. The sequence includes two
+// identical consecutive messages (exercising the "nothing changed" single
+// 0-bit path) and a message where the optional nested sub-message is
+// absent, present, absent again, and present again (exercising the
+// encoder/iterator's handling of a TSZ field whose parent message comes
+// and goes between messages).
+func TestEncodeIterateRoundTrip(t *testing.T) {
+	schema := newTestSchema(t)
+	enc := newTestEncoder(t, schema)
+
+	messages := []*dynamic.Message{
+		buildMessage(t, schema, 1, 1.5, true, 0.5, []string{"a"}, map[string]string{"k1": "v1"}),
+		buildMessage(t, schema, 1, 1.5, true, 0.5, []string{"a"}, map[string]string{"k1": "v1"}),
+		buildMessage(t, schema, 2, 2.5, false, 0, nil, map[string]string{"k1": "v1", "k2": "v2"}),
+		buildMessage(t, schema, 2, 3.5, true, 1.5, []string{"a", "b"}, nil),
+		buildMessage(t, schema, 2, 3.5, false, 0, []string{"a", "b"}, nil),
+		buildMessage(t, schema, 3, 4.5, true, -2.5, []string{"b"}, map[string]string{"k2": "v3"}),
+	}
+
+	for i, m := range messages {
+		// Encode operates on m in place (it strips TSZ leaves from it
+		// before the proto marshal), so hand it a clone and keep the
+		// original around as the expectation to compare against.
+		cloned := dynamic.NewMessage(schema)
+		cloned.MergeFrom(m)
+		require.NoError(t, enc.Encode(cloned), "message %d", i)
+	}
+
+	raw, _ := enc.stream.Rawbytes()
+	it, err := NewIterator(bytes.NewReader(raw), schema, encoding.NewOptions())
+	require.NoError(t, err)
+	defer it.Close()
+
+	for i, want := range messages {
+		require.True(t, it.Next(), "expected message %d, iterator error: %v", i, it.Err())
+		require.True(t, dynamic.MessagesEqual(want, it.Current()),
+			"message %d: want %v, got %v", i, want, it.Current())
+	}
+	require.False(t, it.Next())
+	require.NoError(t, it.Err())
+}
@@ -0,0 +1,135 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package proto
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+	"github.com/m3db/m3/src/dbnode/encoding"
+	"github.com/stretchr/testify/require"
+)
+
+// TestEncodeIterateFuzz encodes a long sequence of messages in which every
+// kind of field (top-level scalar, scalar nested inside an optional
+// sub-message, repeated, and map) is independently and randomly mutated,
+// left alone, or cleared between messages, then asserts that an iterator
+// reading the resulting stream reconstructs the exact same sequence. A
+// fixed seed keeps the test deterministic while still covering far more
+// field-mutation combinations than a hand-picked set of cases would.
+func TestEncodeIterateFuzz(t *testing.T) {
+	const numMessages = 200
+	rng := rand.New(rand.NewSource(42))
+
+	schema := newTestSchema(t)
+	enc := newTestEncoder(t, schema)
+
+	var (
+		messages []*dynamic.Message
+		prev     *dynamic.Message
+	)
+	for i := 0; i < numMessages; i++ {
+		cur := mutateMessage(t, rng, schema, prev)
+		messages = append(messages, cur)
+		prev = cur
+
+		cloned := dynamic.NewMessage(schema)
+		cloned.MergeFrom(cur)
+		require.NoError(t, enc.Encode(cloned), "message %d", i)
+	}
+
+	raw, _ := enc.stream.Rawbytes()
+	it, err := NewIterator(bytes.NewReader(raw), schema, encoding.NewOptions())
+	require.NoError(t, err)
+	defer it.Close()
+
+	for i, want := range messages {
+		require.True(t, it.Next(), "expected message %d, iterator error: %v", i, it.Err())
+		require.True(t, dynamic.MessagesEqual(want, it.Current()),
+			"message %d: want %v, got %v", i, want, it.Current())
+	}
+	require.False(t, it.Next())
+	require.NoError(t, it.Err())
+}
+
+// mutateMessage derives the next message in a fuzz sequence from prev (nil
+// for the first message) by randomly mutating each field independently:
+// scalars are either left alone or given a new random value, the nested
+// sub-message is left alone, cleared, or set/mutated, and the repeated and
+// map fields are left alone, cleared, or have a random element upserted.
+func mutateMessage(
+	t *testing.T,
+	rng *rand.Rand,
+	schema *desc.MessageDescriptor,
+	prev *dynamic.Message,
+) *dynamic.Message {
+	m := dynamic.NewMessage(schema)
+	if prev != nil {
+		m.MergeFrom(prev)
+	}
+
+	if rng.Intn(3) != 0 {
+		require.NoError(t, m.TrySetFieldByName("id", rng.Int63n(1000)))
+	}
+	if rng.Intn(3) != 0 {
+		require.NoError(t, m.TrySetFieldByName("value", rng.Float64()*1000))
+	}
+
+	switch rng.Intn(3) {
+	case 0:
+		// Leave the nested message as-is.
+	case 1:
+		m.ClearFieldByName("nested")
+	default:
+		nestedSchema := schema.FindFieldByName("nested").GetMessageType()
+		nested, _ := m.GetFieldByName("nested").(*dynamic.Message)
+		if nested == nil {
+			nested = dynamic.NewMessage(nestedSchema)
+		}
+		require.NoError(t, nested.TrySetFieldByName("inner", rng.Float32()*1000))
+		require.NoError(t, m.TrySetFieldByName("nested", nested))
+	}
+
+	switch rng.Intn(3) {
+	case 0:
+		// Leave the repeated field as-is.
+	case 1:
+		m.ClearFieldByName("tags")
+	default:
+		require.NoError(t, m.TryAddRepeatedFieldByName("tags", fmt.Sprintf("tag-%d", rng.Intn(5))))
+	}
+
+	switch rng.Intn(3) {
+	case 0:
+		// Leave the map field as-is.
+	case 1:
+		m.ClearFieldByName("attributes")
+	default:
+		require.NoError(t, m.TryPutMapFieldByName("attributes",
+			fmt.Sprintf("k%d", rng.Intn(5)), fmt.Sprintf("v%d", rng.Intn(5))))
+	}
+
+	return m
+}
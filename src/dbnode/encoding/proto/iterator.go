@@ -0,0 +1,606 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package proto
+
+import (
+	"fmt"
+	"io"
+	"math"
+
+	dpb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+	"github.com/m3db/m3/src/dbnode/encoding"
+	"github.com/m3db/m3/src/dbnode/encoding/m3tsz"
+)
+
+// iterator consumes a bitstream produced by encoder and reconstructs the
+// stream of dynamic.Message values that were encoded into it.
+type iterator struct {
+	stream encoding.IStream
+	schema *desc.MessageDescriptor
+	opts   encoding.Options
+
+	tszFields []tszFieldState
+
+	lastDecoded *dynamic.Message
+
+	closed bool
+	err    error
+}
+
+// NewIterator creates a new iterator that mirrors Encode step-for-step.
+func NewIterator(
+	reader io.Reader,
+	schema *desc.MessageDescriptor,
+	opts encoding.Options,
+) (*iterator, error) {
+	return &iterator{
+		stream:    encoding.NewIStream(reader),
+		schema:    schema,
+		opts:      opts,
+		tszFields: tszFields(nil, schema),
+	}, nil
+}
+
+// Next moves to the next message in the stream, returning false when there
+// is nothing left to decode or an error was encountered.
+func (it *iterator) Next() bool {
+	if it.err != nil || it.closed {
+		return false
+	}
+
+	if err := it.decodeTSZValues(); err != nil {
+		if err != io.EOF {
+			it.err = fmt.Errorf("proto iterator error decoding TSZ values: %v", err)
+		}
+		return false
+	}
+
+	if err := it.decodeProtoValues(); err != nil {
+		it.err = fmt.Errorf("proto iterator error decoding proto values: %v", err)
+		return false
+	}
+
+	return true
+}
+
+// Current returns the most recently decoded message. The returned value is
+// only valid until the next call to Next.
+func (it *iterator) Current() *dynamic.Message {
+	return it.lastDecoded
+}
+
+// Err returns any error encountered during iteration.
+func (it *iterator) Err() error {
+	return it.err
+}
+
+// Close closes the iterator.
+func (it *iterator) Close() {
+	it.closed = true
+	it.lastDecoded = nil
+}
+
+func (it *iterator) decodeTSZValues() error {
+	if it.lastDecoded == nil {
+		it.lastDecoded = dynamic.NewMessage(it.schema)
+	}
+
+	for i := range it.tszFields {
+		tszField := &it.tszFields[i]
+		leafNum := int(tszField.fieldPath[len(tszField.fieldPath)-1])
+		parentPath := tszField.fieldPath[:len(tszField.fieldPath)-1]
+
+		var parent *dynamic.Message
+		if len(parentPath) == 0 {
+			parent = it.lastDecoded
+		} else {
+			present, err := it.stream.ReadBit()
+			if err != nil {
+				return err
+			}
+			if present == 0 {
+				// Not set on the encoded message, so there's nothing to
+				// read for this field. Leave the message(s) along the path
+				// alone (their presence, or lack thereof, is handled by
+				// decodeProtoValues) and reset delta state so a later
+				// reappearance is read as an absolute value.
+				tszField.hasPrev = false
+				continue
+			}
+
+			parent, err = navigateToNestedMessageForDecode(it.lastDecoded, parentPath)
+			if err != nil {
+				return err
+			}
+		}
+
+		var bits uint64
+		if !tszField.hasPrev {
+			v, err := it.stream.ReadBits(64)
+			if err != nil {
+				return err
+			}
+			bits = v
+			tszField.prevBits = bits
+			tszField.prevXOR = bits
+			tszField.hasPrev = true
+		} else {
+			xor, err := m3tsz.ReadXOR(it.stream, tszField.prevXOR)
+			if err != nil {
+				return err
+			}
+			bits = tszField.prevBits ^ xor
+			tszField.prevXOR = xor
+			tszField.prevBits = bits
+		}
+
+		if err := setTSZFieldValue(parent, leafNum, tszField.fieldType, bits); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// navigateToNestedMessageForDecode is navigateToNestedMessage's decode-side
+// counterpart: it creates any nested messages along path that aren't set
+// yet instead of erroring, since the decoder is reconstructing the message
+// from scratch.
+func navigateToNestedMessageForDecode(m *dynamic.Message, path []int32) (*dynamic.Message, error) {
+	cur := m
+	for _, fieldNum := range path {
+		fd := cur.GetMessageDescriptor().FindFieldByNumber(fieldNum)
+		if fd == nil {
+			return nil, fmt.Errorf(
+				"proto iterator error: field number %d not present in schema", fieldNum)
+		}
+
+		iVal, err := cur.TryGetFieldByNumber(int(fieldNum))
+		if err != nil {
+			return nil, err
+		}
+
+		nested, ok := iVal.(*dynamic.Message)
+		if !ok || nested == nil {
+			nested = dynamic.NewMessage(fd.GetMessageType())
+			if err := cur.TrySetFieldByNumber(int(fieldNum), nested); err != nil {
+				return nil, err
+			}
+		}
+		cur = nested
+	}
+
+	return cur, nil
+}
+
+func (it *iterator) decodeProtoValues() error {
+	changedBit, err := it.stream.ReadBit()
+	if err != nil {
+		return err
+	}
+
+	if changedBit == 0 {
+		// Nothing has changed since the last message.
+		return nil
+	}
+
+	if it.lastDecoded == nil {
+		it.lastDecoded = dynamic.NewMessage(it.schema)
+	}
+
+	// Walk the hierarchical change descriptor, applying any out-of-band
+	// repeated/map deltas directly onto lastDecoded as we go. Scalar leaf
+	// changes (including ones nested inside changed sub-messages) don't
+	// need any action here: they're part of the marshaled remainder below,
+	// and dynamic.Message.MergeFrom already recurses into message-type
+	// fields, so merging it in leaves fields that weren't remarshaled at
+	// their prior values.
+	if err := it.readChangeSet(it.lastDecoded, it.schema); err != nil {
+		return err
+	}
+
+	size, err := it.readVarInt()
+	if err != nil {
+		return err
+	}
+
+	marshaled, err := it.stream.ReadBytes(int(size))
+	if err != nil {
+		return err
+	}
+
+	next := dynamic.NewMessage(it.schema)
+	if err := next.Unmarshal(marshaled); err != nil {
+		return fmt.Errorf("proto iterator error trying to unmarshal protobuf: %v", err)
+	}
+
+	it.lastDecoded.MergeFrom(next)
+
+	return nil
+}
+
+// readChangeSet mirrors encoder.writeChangeSet: it reads the bitset of
+// field numbers that changed at this level of m and, for each one in
+// ascending field-number order, either recurses into its nested change
+// descriptor (nested messages) or applies its out-of-band delta payload
+// (repeated/map fields) directly onto m.
+func (it *iterator) readChangeSet(m *dynamic.Message, schema *desc.MessageDescriptor) error {
+	changedNums, err := it.readBitset()
+	if err != nil {
+		return err
+	}
+
+	for _, num := range changedNums {
+		field := schema.FindFieldByNumber(int32(num))
+		if field == nil {
+			return fmt.Errorf(
+				"proto iterator error: field number %d not present in schema", num)
+		}
+
+		if field.IsMap() {
+			if err := it.readMapFieldDelta(m, field, num); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if field.IsRepeated() {
+			if err := it.readRepeatedFieldDelta(m, field, num); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if field.GetType() != dpb.FieldDescriptorProto_TYPE_MESSAGE {
+			// Scalar leaf change: carried in the marshaled remainder and
+			// applied by the MergeFrom in decodeProtoValues.
+			continue
+		}
+
+		hasNested, err := it.stream.ReadBit()
+		if err != nil {
+			return err
+		}
+		if hasNested == 0 {
+			// Fully new/replaced nested message: carried whole in the
+			// marshaled remainder.
+			continue
+		}
+
+		nested, ok := m.GetFieldByNumber(num).(*dynamic.Message)
+		if !ok || nested == nil {
+			nested = dynamic.NewMessage(field.GetMessageType())
+			if err := m.TrySetFieldByNumber(num, nested); err != nil {
+				return err
+			}
+		}
+		if err := it.readChangeSet(nested, field.GetMessageType()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readRepeatedFieldDelta is the inverse of diffRepeatedField: it reads the
+// new length followed by a varint-prefixed list of (index, newValue)
+// deltas and rebuilds the repeated field on m from its prior elements plus
+// those deltas.
+func (it *iterator) readRepeatedFieldDelta(m *dynamic.Message, field *desc.FieldDescriptor, num int) error {
+	newLen, err := it.readVarInt()
+	if err != nil {
+		return err
+	}
+	numChanges, err := it.readVarInt()
+	if err != nil {
+		return err
+	}
+
+	isMessage := field.GetType() == dpb.FieldDescriptorProto_TYPE_MESSAGE
+
+	existingLen := m.FieldLength(field)
+	keptLen := existingLen
+	if uint64(keptLen) > newLen {
+		// The field shrank: only the first newLen prior elements survive.
+		keptLen = int(newLen)
+	}
+
+	elems := make([]interface{}, 0, newLen)
+	for i := 0; i < keptLen; i++ {
+		elems = append(elems, m.GetRepeatedFieldByNumber(num, i))
+	}
+	for uint64(len(elems)) < newLen {
+		elems = append(elems, zeroValueForField(field))
+	}
+
+	for i := uint64(0); i < numChanges; i++ {
+		index, err := it.readVarInt()
+		if err != nil {
+			return err
+		}
+
+		var val interface{}
+		if isMessage {
+			val, err = it.readMessageValue(field.GetMessageType())
+		} else {
+			val, err = it.readScalarValue(field.GetType())
+		}
+		if err != nil {
+			return err
+		}
+
+		elems[index] = val
+	}
+
+	m.ClearFieldByNumber(num)
+	for _, v := range elems {
+		if err := m.TryAddRepeatedFieldByNumber(num, v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readMapFieldDelta is the inverse of diffMapField: it reads the removed
+// keys followed by the added/updated (key, newValue) pairs and applies
+// them directly to m's map field.
+func (it *iterator) readMapFieldDelta(m *dynamic.Message, field *desc.FieldDescriptor, num int) error {
+	mapEntry := field.GetMessageType()
+	keyField := mapEntry.FindFieldByNumber(1)
+	valueField := mapEntry.FindFieldByNumber(2)
+	isMessage := valueField.GetType() == dpb.FieldDescriptorProto_TYPE_MESSAGE
+
+	numRemoved, err := it.readVarInt()
+	if err != nil {
+		return err
+	}
+	for i := uint64(0); i < numRemoved; i++ {
+		k, err := it.readScalarValue(keyField.GetType())
+		if err != nil {
+			return err
+		}
+		m.RemoveMapFieldByNumber(num, k)
+	}
+
+	numUpserts, err := it.readVarInt()
+	if err != nil {
+		return err
+	}
+	for i := uint64(0); i < numUpserts; i++ {
+		k, err := it.readScalarValue(keyField.GetType())
+		if err != nil {
+			return err
+		}
+
+		var v interface{}
+		if isMessage {
+			v, err = it.readMessageValue(valueField.GetMessageType())
+		} else {
+			v, err = it.readScalarValue(valueField.GetType())
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := m.PutMapFieldByNumber(num, k, v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readMessageValue is the inverse of encoder.writeMessageValue.
+func (it *iterator) readMessageValue(schema *desc.MessageDescriptor) (*dynamic.Message, error) {
+	n, err := it.readVarInt()
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		// writeMessageValue writes a zero length for an empty message, whose
+		// marshaled form is empty.
+		return dynamic.NewMessage(schema), nil
+	}
+
+	b, err := it.stream.ReadBytes(int(n))
+	if err != nil {
+		return nil, err
+	}
+
+	msg := dynamic.NewMessage(schema)
+	if err := msg.Unmarshal(b); err != nil {
+		return nil, fmt.Errorf("proto iterator error trying to unmarshal nested message value: %v", err)
+	}
+	return msg, nil
+}
+
+// readScalarValue is the inverse of encoder.writeScalarValue.
+func (it *iterator) readScalarValue(fieldType dpb.FieldDescriptorProto_Type) (interface{}, error) {
+	switch fieldType {
+	case dpb.FieldDescriptorProto_TYPE_DOUBLE:
+		bits, err := it.stream.ReadBits(64)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(bits), nil
+	case dpb.FieldDescriptorProto_TYPE_FLOAT:
+		bits, err := it.stream.ReadBits(32)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float32frombits(uint32(bits)), nil
+	case dpb.FieldDescriptorProto_TYPE_BOOL:
+		bit, err := it.stream.ReadBit()
+		if err != nil {
+			return nil, err
+		}
+		return bit == 1, nil
+	case dpb.FieldDescriptorProto_TYPE_STRING:
+		n, err := it.readVarInt()
+		if err != nil {
+			return nil, err
+		}
+		b, err := it.stream.ReadBytes(int(n))
+		if err != nil {
+			return nil, err
+		}
+		return string(b), nil
+	case dpb.FieldDescriptorProto_TYPE_BYTES:
+		n, err := it.readVarInt()
+		if err != nil {
+			return nil, err
+		}
+		return it.stream.ReadBytes(int(n))
+	case dpb.FieldDescriptorProto_TYPE_INT64,
+		dpb.FieldDescriptorProto_TYPE_SINT64,
+		dpb.FieldDescriptorProto_TYPE_SFIXED64:
+		v, err := it.readVarInt()
+		if err != nil {
+			return nil, err
+		}
+		return int64(v), nil
+	case dpb.FieldDescriptorProto_TYPE_INT32,
+		dpb.FieldDescriptorProto_TYPE_SINT32,
+		dpb.FieldDescriptorProto_TYPE_SFIXED32:
+		v, err := it.readVarInt()
+		if err != nil {
+			return nil, err
+		}
+		return int32(uint32(v)), nil
+	case dpb.FieldDescriptorProto_TYPE_UINT64, dpb.FieldDescriptorProto_TYPE_FIXED64:
+		return it.readVarInt()
+	case dpb.FieldDescriptorProto_TYPE_UINT32, dpb.FieldDescriptorProto_TYPE_FIXED32:
+		v, err := it.readVarInt()
+		if err != nil {
+			return nil, err
+		}
+		return uint32(v), nil
+	default:
+		return nil, fmt.Errorf("proto iterator error: unsupported scalar field type: %v", fieldType)
+	}
+}
+
+// zeroValueForField returns field's proto3 zero value, used to pad out a
+// repeated field to its new length when readRepeatedFieldDelta doesn't
+// have an explicit delta for every trailing index.
+func zeroValueForField(field *desc.FieldDescriptor) interface{} {
+	switch field.GetType() {
+	case dpb.FieldDescriptorProto_TYPE_DOUBLE:
+		return float64(0)
+	case dpb.FieldDescriptorProto_TYPE_FLOAT:
+		return float32(0)
+	case dpb.FieldDescriptorProto_TYPE_BOOL:
+		return false
+	case dpb.FieldDescriptorProto_TYPE_STRING:
+		return ""
+	case dpb.FieldDescriptorProto_TYPE_BYTES:
+		return []byte(nil)
+	case dpb.FieldDescriptorProto_TYPE_INT64,
+		dpb.FieldDescriptorProto_TYPE_SINT64,
+		dpb.FieldDescriptorProto_TYPE_SFIXED64:
+		return int64(0)
+	case dpb.FieldDescriptorProto_TYPE_INT32,
+		dpb.FieldDescriptorProto_TYPE_SINT32,
+		dpb.FieldDescriptorProto_TYPE_SFIXED32:
+		return int32(0)
+	case dpb.FieldDescriptorProto_TYPE_UINT64, dpb.FieldDescriptorProto_TYPE_FIXED64:
+		return uint64(0)
+	case dpb.FieldDescriptorProto_TYPE_UINT32, dpb.FieldDescriptorProto_TYPE_FIXED32:
+		return uint32(0)
+	case dpb.FieldDescriptorProto_TYPE_MESSAGE:
+		return dynamic.NewMessage(field.GetMessageType())
+	default:
+		return nil
+	}
+}
+
+// readBitset mirrors writeBitset: a varint indicating how many of the
+// following bits to interpret, followed by that many bits.
+func (it *iterator) readBitset() ([]int, error) {
+	n, err := it.readVarInt()
+	if err != nil {
+		return nil, err
+	}
+
+	var set []int
+	for i := 0; i < int(n); i++ {
+		bit, err := it.stream.ReadBit()
+		if err != nil {
+			return nil, err
+		}
+		if bit == 1 {
+			set = append(set, i)
+		}
+	}
+
+	return set, nil
+}
+
+// readVarInt mirrors writeVarInt.
+func (it *iterator) readVarInt() (uint64, error) {
+	var x uint64
+	for shift := uint(0); shift < 64; shift += 7 {
+		b, err := it.stream.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if b < 0x80 {
+			return x | uint64(b)<<shift, nil
+		}
+		x |= uint64(b&0x7f) << shift
+	}
+
+	return 0, fmt.Errorf("proto iterator error: varint overflows 64 bits")
+}
+
+// setTSZFieldValue is the inverse of tszFieldBits: it reinterprets the
+// uint64 produced by the XOR delta path back into the Go type that the
+// wire type expects.
+func setTSZFieldValue(
+	m *dynamic.Message,
+	fieldNum int,
+	fieldType dpb.FieldDescriptorProto_Type,
+	bits uint64,
+) error {
+	switch fieldType {
+	case dpb.FieldDescriptorProto_TYPE_DOUBLE:
+		return m.TrySetFieldByNumber(fieldNum, math.Float64frombits(bits))
+	case dpb.FieldDescriptorProto_TYPE_FLOAT:
+		return m.TrySetFieldByNumber(fieldNum, float32(math.Float64frombits(bits)))
+	case dpb.FieldDescriptorProto_TYPE_INT64,
+		dpb.FieldDescriptorProto_TYPE_SINT64,
+		dpb.FieldDescriptorProto_TYPE_SFIXED64:
+		return m.TrySetFieldByNumber(fieldNum, int64(bits))
+	case dpb.FieldDescriptorProto_TYPE_INT32,
+		dpb.FieldDescriptorProto_TYPE_SINT32,
+		dpb.FieldDescriptorProto_TYPE_SFIXED32:
+		return m.TrySetFieldByNumber(fieldNum, int32(int64(bits)))
+	case dpb.FieldDescriptorProto_TYPE_UINT64, dpb.FieldDescriptorProto_TYPE_FIXED64:
+		return m.TrySetFieldByNumber(fieldNum, bits)
+	case dpb.FieldDescriptorProto_TYPE_UINT32, dpb.FieldDescriptorProto_TYPE_FIXED32:
+		return m.TrySetFieldByNumber(fieldNum, uint32(bits))
+	default:
+		return fmt.Errorf("proto iterator error: field type %v is not TSZ-eligible", fieldType)
+	}
+}
@@ -0,0 +1,51 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package proto
+
+import (
+	"testing"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/desc/builder"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestSchema builds the schema shared by the round-trip and fuzz tests:
+// a couple of top-level TSZ-eligible scalars, a TSZ-eligible scalar nested
+// inside an optional sub-message (to exercise the encoder/iterator's
+// handling of an absent parent message), a repeated scalar field, and a
+// string->string map field.
+func newTestSchema(t *testing.T) *desc.MessageDescriptor {
+	nested := builder.NewMessage("Nested").
+		AddField(builder.NewField("inner", builder.FieldTypeFloat()).SetNumber(1))
+
+	msg := builder.NewMessage("TestMessage").
+		AddField(builder.NewField("id", builder.FieldTypeInt64()).SetNumber(1)).
+		AddField(builder.NewField("value", builder.FieldTypeDouble()).SetNumber(2)).
+		AddField(builder.NewField("nested", builder.FieldTypeMessage(nested)).SetNumber(3)).
+		AddField(builder.NewField("tags", builder.FieldTypeString()).SetNumber(4).SetRepeated()).
+		AddField(builder.NewField("attributes",
+			builder.FieldTypeMap(builder.FieldTypeString(), builder.FieldTypeString())).SetNumber(5))
+
+	schema, err := msg.Build()
+	require.NoError(t, err)
+	return schema
+}
@@ -21,40 +21,170 @@
 package storage
 
 import (
+	"bytes"
+	"regexp"
+
 	"github.com/m3db/m3/src/query/graphite/graphite"
 	"github.com/m3db/m3/src/query/models"
 )
 
 const (
-	carbonSeparatorByte = byte('.')
-	carbonGlobRune      = '*'
+	carbonGlobRune       = '*'
+	carbonSingleRune     = '?'
+	carbonAltStartRune   = '{'
+	carbonAltEndRune     = '}'
+	carbonAltSepRune     = ','
+	carbonClassStartRune = '['
+	carbonClassEndRune   = ']'
+	carbonEscapeRune     = '\\'
 )
 
 var (
-	wildcard = []byte(".*")
+	// wildcard matches any non-empty tag value; used by matcherTerminator to
+	// negate a match on a tag number that must not be present. Anchored to
+	// match the whole value for consistency with glob's anchored output,
+	// though .* would match unconditionally either way.
+	wildcard = []byte("^.*$")
 )
 
+// glob translates a single Graphite metric path segment (which may contain
+// the metavariables that Graphite's carbon matcher supports: `*`, `?`,
+// `{a,b,c}` alternation, and `[...]` character classes) into the regular
+// expression that matches the same set of segments. Regex metacharacters
+// that appear literally in the input (outside of a character class) are
+// escaped so they aren't misinterpreted, and the result is anchored so it
+// matches the whole segment rather than a substring of it.
 func glob(metric string) []byte {
-	globLen := len(metric)
-	for _, c := range metric {
-		if c == carbonGlobRune {
-			globLen++
+	var buf bytes.Buffer
+	buf.WriteByte('^')
+	writeGlob(&buf, []rune(metric))
+	buf.WriteByte('$')
+	return buf.Bytes()
+}
+
+// writeGlob writes runes' translated regex to buf, with no surrounding
+// anchors. It's split out from glob so that each branch of an alternation
+// group can be translated the same way as the top-level expression (an
+// alternation branch may itself contain wildcards or nested alternation,
+// e.g. `{a,{b,c}}`).
+func writeGlob(buf *bytes.Buffer, runes []rune) {
+	for i := 0; i < len(runes); i++ {
+		c := runes[i]
+		switch c {
+		case carbonGlobRune:
+			// '*' matches any run of characters within a single segment.
+			buf.WriteString("[^.]*")
+		case carbonSingleRune:
+			// '?' matches exactly one character within a single segment.
+			buf.WriteString("[^.]")
+		case carbonAltStartRune:
+			end := matchingBraceIndex(runes, i+1)
+			if end < 0 {
+				// No matching '}': treat the brace as a literal.
+				buf.WriteString(regexp.QuoteMeta(string(c)))
+				continue
+			}
+
+			alts := splitTopLevel(runes[i+1:end], carbonAltSepRune)
+			buf.WriteString("(?:")
+			for j, alt := range alts {
+				if j > 0 {
+					buf.WriteByte('|')
+				}
+				writeGlob(buf, alt)
+			}
+			buf.WriteString(")")
+			i = end
+		case carbonClassStartRune:
+			end := indexRune(runes, i+1, carbonClassEndRune)
+			if end < 0 {
+				// No matching ']': treat the bracket as a literal.
+				buf.WriteString(regexp.QuoteMeta(string(c)))
+				continue
+			}
+
+			buf.WriteByte('[')
+			for _, r := range runes[i+1 : end] {
+				if r == '.' {
+					buf.WriteString(`\.`)
+				} else {
+					buf.WriteRune(r)
+				}
+			}
+			buf.WriteByte(']')
+			i = end
+		case carbonEscapeRune:
+			if i+1 < len(runes) {
+				buf.WriteString(regexp.QuoteMeta(string(runes[i+1])))
+				i++
+			} else {
+				buf.WriteString(regexp.QuoteMeta(string(c)))
+			}
+		default:
+			buf.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+}
+
+// indexRune returns the index of the first occurrence of target in runes
+// at or after start, or -1 if there is none.
+func indexRune(runes []rune, start int, target rune) int {
+	for i := start; i < len(runes); i++ {
+		if runes[i] == target {
+			return i
 		}
 	}
+	return -1
+}
 
-	glob := make([]byte, globLen)
-	i := 0
-	for _, c := range metric {
-		if c == carbonGlobRune {
-			glob[i] = carbonSeparatorByte
-			i++
+// matchingBraceIndex returns the index in runes (at or after start) of the
+// '}' that closes the '{' immediately preceding start, accounting for '{'
+// nested inside the group, or -1 if there is none. A plain indexRune scan
+// for the first '}' would mis-parse nested alternation like `{a,{b,c}}`,
+// splitting it on the comma inside the nested group rather than treating
+// `{b,c}` as a single branch.
+func matchingBraceIndex(runes []rune, start int) int {
+	depth := 0
+	for i := start; i < len(runes); i++ {
+		switch runes[i] {
+		case carbonAltStartRune:
+			depth++
+		case carbonAltEndRune:
+			if depth == 0 {
+				return i
+			}
+			depth--
 		}
+	}
+	return -1
+}
+
+// splitTopLevel splits runes on sep, ignoring occurrences of sep nested
+// inside a '{'...'}' alternation group, so that e.g. splitting
+// "a,{b,c}" on ',' yields ["a", "{b,c}"] rather than ["a", "{b", "c}"].
+func splitTopLevel(runes []rune, sep rune) [][]rune {
+	var parts [][]rune
 
-		glob[i] = byte(c)
-		i++
+	depth := 0
+	last := 0
+	for i, r := range runes {
+		switch r {
+		case carbonAltStartRune:
+			depth++
+		case carbonAltEndRune:
+			if depth > 0 {
+				depth--
+			}
+		case sep:
+			if depth == 0 {
+				parts = append(parts, runes[last:i])
+				last = i + 1
+			}
+		}
 	}
+	parts = append(parts, runes[last:])
 
-	return glob
+	return parts
 }
 
 func convertMetricPartToMatcher(count int, metric string) models.Matcher {
@@ -0,0 +1,124 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package storage
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGlob(t *testing.T) {
+	tests := []struct {
+		name    string
+		metric  string
+		matches []string
+		noMatch []string
+	}{
+		{
+			name:    "plain literal",
+			metric:  "cpu",
+			matches: []string{"cpu"},
+			noMatch: []string{"cpu2", "gpu"},
+		},
+		{
+			name:    "star wildcard",
+			metric:  "cpu*",
+			matches: []string{"cpu", "cpu0", "cpu-total"},
+			noMatch: []string{"gpu0"},
+		},
+		{
+			name:    "question mark wildcard",
+			metric:  "cpu?",
+			matches: []string{"cpu0", "cpuX"},
+			noMatch: []string{"cpu", "cpu01"},
+		},
+		{
+			name:    "mixed wildcards",
+			metric:  "cpu?-*",
+			matches: []string{"cpu0-total", "cpu9-idle"},
+			noMatch: []string{"cpu-total", "cpu01-total"},
+		},
+		{
+			name:    "character class",
+			metric:  "cpu[0-2]",
+			matches: []string{"cpu0", "cpu1", "cpu2"},
+			noMatch: []string{"cpu3", "cpu"},
+		},
+		{
+			name:    "alternation",
+			metric:  "{cpu,gpu}",
+			matches: []string{"cpu", "gpu"},
+			noMatch: []string{"cpux", "tpu"},
+		},
+		{
+			name:    "nested alternation",
+			metric:  "{cpu,g{pu,pus}}",
+			matches: []string{"cpu", "gpu", "gpus"},
+			noMatch: []string{"gp", "cpus"},
+		},
+		{
+			name:    "doubly nested alternation",
+			metric:  "{a,{b,{c,d}}}",
+			matches: []string{"a", "b", "c", "d"},
+			noMatch: []string{"e", "{c,d}"},
+		},
+		{
+			name:    "escaped brace is literal",
+			metric:  `cpu\{0\}`,
+			matches: []string{"cpu{0}"},
+			noMatch: []string{"cpu0"},
+		},
+		{
+			name:    "escaped bracket is literal",
+			metric:  `cpu\[0\]`,
+			matches: []string{"cpu[0]"},
+			noMatch: []string{"cpu0"},
+		},
+		{
+			name:    "unmatched brace is literal",
+			metric:  "cpu{0",
+			matches: []string{"cpu{0"},
+			noMatch: []string{"cpu0"},
+		},
+		{
+			name:    "regex metacharacters are escaped",
+			metric:  "cpu.total+",
+			matches: []string{"cpu.total+"},
+			noMatch: []string{"cpuXtotal+", "cpu.total"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			re, err := regexp.Compile(string(glob(tt.metric)))
+			require.NoError(t, err)
+
+			for _, m := range tt.matches {
+				require.True(t, re.MatchString(m), "expected %q to match %q", tt.metric, m)
+			}
+			for _, m := range tt.noMatch {
+				require.False(t, re.MatchString(m), "expected %q not to match %q", tt.metric, m)
+			}
+		})
+	}
+}
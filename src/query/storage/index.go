@@ -21,10 +21,12 @@
 package storage
 
 import (
+	"encoding/binary"
 	"fmt"
 	"sync"
 	"time"
 
+	"github.com/cespare/xxhash"
 	"github.com/m3db/m3/src/dbnode/generated/thrift/rpc"
 	"github.com/m3db/m3/src/dbnode/storage/index"
 	"github.com/m3db/m3/src/m3ninx/idx"
@@ -32,26 +34,61 @@ import (
 	"github.com/m3db/m3x/ident"
 )
 
-// QueryConversionCache represents the query conversion LRU cache.
+// QueryConversionCache represents the query conversion cache. Reads always
+// consult the in-memory LRU first; on a miss they read through to backend
+// (the LRU itself by default; with a persistent backend such as
+// BoltQueryConversionBackend, compiled regex matchers survive process
+// restarts and can be shared across sibling coordinator instances rather
+// than being recompiled from scratch by each of them).
 type QueryConversionCache struct {
 	sync.RWMutex
 
-	lru *QueryConversionLRU
+	lru     *QueryConversionLRU
+	backend QueryConversionBackend
 }
 
-// NewQueryConversionCache creates a new QueryConversionCache with a provided LRU cache.
+// NewQueryConversionCache creates a new QueryConversionCache with a provided
+// LRU cache and no persistent backend (the LRU itself is used as the
+// backend, so compiles are never shared beyond the local process). Use
+// NewQueryConversionCacheWithBackend to plug in a persistent backend.
 func NewQueryConversionCache(lru *QueryConversionLRU) *QueryConversionCache {
+	return NewQueryConversionCacheWithBackend(lru, newLRUQueryConversionBackend(lru))
+}
+
+// NewQueryConversionCacheWithBackend creates a new QueryConversionCache that
+// reads through to backend on an LRU miss and populates both the LRU and
+// the backend whenever a matcher is compiled.
+func NewQueryConversionCacheWithBackend(
+	lru *QueryConversionLRU,
+	backend QueryConversionBackend,
+) *QueryConversionCache {
 	return &QueryConversionCache{
-		lru: lru,
+		lru:     lru,
+		backend: backend,
 	}
 }
 
-func (q *QueryConversionCache) set(k []byte, v idx.Query) bool {
-	return q.lru.Set(k, v)
+func (q *QueryConversionCache) set(k []byte, v idx.Query) error {
+	q.lru.Set(k, v)
+	return q.backend.Set(k, v)
 }
 
-func (q *QueryConversionCache) get(k []byte) (idx.Query, bool) {
-	return q.lru.Get(k)
+func (q *QueryConversionCache) get(k []byte) (idx.Query, bool, error) {
+	if v, ok := q.lru.Get(k); ok {
+		return v, true, nil
+	}
+
+	v, ok, err := q.backend.Get(k)
+	if err != nil {
+		return idx.Query{}, false, err
+	}
+	if ok {
+		// Populate the LRU so repeat lookups don't keep round-tripping to
+		// the backend.
+		q.lru.Set(k, v)
+	}
+
+	return v, ok, nil
 }
 
 // FromM3IdentToMetric converts an M3 ident metric to a coordinator metric.
@@ -140,26 +177,31 @@ func FetchOptionsToAggregateOptions(
 	}
 }
 
-var (
-	// byte representation for [1,2,3,4]
-	lookup = [4]byte{49, 50, 51, 52}
-)
-
+// queryKey derives a fixed-length, collision-resistant cache key from
+// matchers by xxhash-summing a length-delimited encoding of each matcher's
+// name, type, and value. Length-delimiting each field (rather than just
+// concatenating them, as the previous [1,2,3,4] matcher-type encoding
+// did) keeps e.g. {name: "ab", value: "c"} distinct from {name: "a",
+// value: "bc"}; hashing down to a fixed-length key keeps it cheap to
+// persist and compare in a QueryConversionBackend.
 func queryKey(m models.Matchers) []byte {
-	l := len(m)
-	for _, t := range m {
-		l += len(t.Name) + len(t.Value)
-	}
+	digest := xxhash.New()
 
-	key := make([]byte, l)
-	idx := 0
+	var lenBuf [8]byte
 	for _, t := range m {
-		idx += copy(key[idx:], t.Name)
-		key[idx] = lookup[t.Type]
-		idx += copy(key[idx+1:], t.Value)
-		idx++
+		binary.LittleEndian.PutUint64(lenBuf[:], uint64(len(t.Name)))
+		digest.Write(lenBuf[:])
+		digest.Write(t.Name)
+
+		digest.Write([]byte{byte(t.Type)})
+
+		binary.LittleEndian.PutUint64(lenBuf[:], uint64(len(t.Value)))
+		digest.Write(lenBuf[:])
+		digest.Write(t.Value)
 	}
 
+	key := make([]byte, 8)
+	binary.LittleEndian.PutUint64(key, digest.Sum64())
 	return key
 }
 
@@ -179,13 +221,15 @@ func FetchQueryToM3Query(
 
 	k := queryKey(matchers)
 	cache.RLock()
-
-	if val, ok := cache.get(k); ok {
-		cache.RUnlock()
+	val, ok, err := cache.get(k)
+	cache.RUnlock()
+	if err != nil {
+		return index.Query{}, err
+	}
+	if ok {
 		return index.Query{Query: val}, nil
 	}
 
-	cache.RUnlock()
 	// Optimization for single matcher case.
 	if len(matchers) == 1 {
 		q, err := matcherToQuery(matchers[0])
@@ -194,13 +238,15 @@ func FetchQueryToM3Query(
 		}
 
 		cache.Lock()
-		cache.set(k, q)
+		err = cache.set(k, q)
 		cache.Unlock()
+		if err != nil {
+			return index.Query{}, err
+		}
 		return index.Query{Query: q}, nil
 	}
 
 	idxQueries := make([]idx.Query, len(matchers))
-	var err error
 	for i, matcher := range matchers {
 		idxQueries[i], err = matcherToQuery(matcher)
 		if err != nil {
@@ -210,8 +256,11 @@ func FetchQueryToM3Query(
 
 	q := idx.NewConjunctionQuery(idxQueries...)
 	cache.Lock()
-	cache.set(k, q)
+	err = cache.set(k, q)
 	cache.Unlock()
+	if err != nil {
+		return index.Query{}, err
+	}
 
 	return index.Query{Query: q}, nil
 }
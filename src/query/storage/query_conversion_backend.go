@@ -0,0 +1,58 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package storage
+
+import (
+	"github.com/m3db/m3/src/m3ninx/idx"
+)
+
+// QueryConversionBackend is a store for compiled idx.Query values, keyed by
+// queryKey. QueryConversionCache always checks its in-memory LRU first and
+// reads through to a QueryConversionBackend on a miss, so a backend that
+// persists (e.g. an embedded KV store) lets compiled regex matchers
+// survive process restarts and be shared across sibling coordinators.
+type QueryConversionBackend interface {
+	// Get returns the previously-compiled query for key, if any.
+	Get(key []byte) (idx.Query, bool, error)
+	// Set stores the compiled query for key.
+	Set(key []byte, q idx.Query) error
+}
+
+// lruQueryConversionBackend adapts a QueryConversionLRU to the
+// QueryConversionBackend interface so that a QueryConversionCache created
+// without an explicit backend still has one to read through to.
+type lruQueryConversionBackend struct {
+	lru *QueryConversionLRU
+}
+
+func newLRUQueryConversionBackend(lru *QueryConversionLRU) QueryConversionBackend {
+	return &lruQueryConversionBackend{lru: lru}
+}
+
+func (b *lruQueryConversionBackend) Get(key []byte) (idx.Query, bool, error) {
+	q, ok := b.lru.Get(key)
+	return q, ok, nil
+}
+
+func (b *lruQueryConversionBackend) Set(key []byte, q idx.Query) error {
+	b.lru.Set(key, q)
+	return nil
+}
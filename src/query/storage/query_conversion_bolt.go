@@ -0,0 +1,252 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/m3db/m3/src/m3ninx/generated/proto/querypb"
+	"github.com/m3db/m3/src/m3ninx/idx"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	queryConversionBucket = []byte("query_conversion")
+	// queryConversionOrderBucket indexes queryConversionBucket's keys by
+	// writtenAt so that Set can evict the least-recently-written entries
+	// once maxEntries is exceeded without having to scan the whole main
+	// bucket. Its keys are an 8-byte big-endian UnixNano timestamp followed
+	// by the entry's key (big-endian so Bolt's natural byte-order cursor
+	// iteration is also oldest-first); its values are the bare entry key.
+	queryConversionOrderBucket = []byte("query_conversion_order")
+)
+
+// BoltQueryConversionBackend is a QueryConversionBackend backed by an
+// embedded BoltDB file, so compiled queries survive process restarts and
+// can be shared across sibling coordinator instances that mount the same
+// file (e.g. on a shared volume).
+type BoltQueryConversionBackend struct {
+	db         *bolt.DB
+	ttl        time.Duration
+	maxEntries int
+}
+
+// NewBoltQueryConversionBackend opens (creating if necessary) a BoltDB
+// file at path to back a QueryConversionBackend. Entries older than ttl
+// are treated as a miss and are lazily removed on their next read; ttl <=
+// 0 disables expiry. Once the backend holds more than maxEntries entries,
+// Set evicts the least-recently-written ones until it's back under the
+// cap; maxEntries <= 0 disables the size cap.
+func NewBoltQueryConversionBackend(path string, ttl time.Duration, maxEntries int) (*BoltQueryConversionBackend, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("query conversion backend: error opening bolt db: %v", err)
+	}
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(queryConversionBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(queryConversionOrderBucket)
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("query conversion backend: error creating bucket: %v", err)
+	}
+
+	return &BoltQueryConversionBackend{db: db, ttl: ttl, maxEntries: maxEntries}, nil
+}
+
+// Close closes the underlying BoltDB file.
+func (b *BoltQueryConversionBackend) Close() error {
+	return b.db.Close()
+}
+
+// Get implements QueryConversionBackend.
+func (b *BoltQueryConversionBackend) Get(key []byte) (idx.Query, bool, error) {
+	var (
+		q                idx.Query
+		found            bool
+		expired          bool
+		expiredWrittenAt time.Time
+	)
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(queryConversionBucket).Get(key)
+		if v == nil {
+			return nil
+		}
+
+		entry, err := decodeQueryConversionEntry(v)
+		if err != nil {
+			return err
+		}
+		if b.ttl > 0 && time.Since(entry.writtenAt) > b.ttl {
+			expired = true
+			expiredWrittenAt = entry.writtenAt
+			return nil
+		}
+
+		q = entry.query
+		found = true
+		return nil
+	})
+	if err != nil {
+		return idx.Query{}, false, err
+	}
+
+	if expired {
+		// Best-effort cleanup; a failure here just means we'll pay the
+		// decode-and-check cost again next time this key is read.
+		_ = b.db.Update(func(tx *bolt.Tx) error {
+			return deleteQueryConversionEntry(tx, key, expiredWrittenAt)
+		})
+	}
+
+	return q, found, nil
+}
+
+// Set implements QueryConversionBackend.
+func (b *BoltQueryConversionBackend) Set(key []byte, q idx.Query) error {
+	writtenAt := time.Now()
+	v, err := encodeQueryConversionEntry(queryConversionEntry{query: q, writtenAt: writtenAt})
+	if err != nil {
+		return err
+	}
+
+	return b.db.Update(func(tx *bolt.Tx) error {
+		mainBucket := tx.Bucket(queryConversionBucket)
+
+		// A key being overwritten has a stale order entry (keyed by its
+		// old writtenAt) that needs to come out first, or it would be
+		// evicted in place of key's new, up-to-date entry.
+		if old := mainBucket.Get(key); old != nil {
+			oldEntry, err := decodeQueryConversionEntry(old)
+			if err != nil {
+				return err
+			}
+			if err := tx.Bucket(queryConversionOrderBucket).Delete(queryConversionOrderKey(oldEntry.writtenAt, key)); err != nil {
+				return err
+			}
+		}
+
+		if err := mainBucket.Put(key, v); err != nil {
+			return err
+		}
+		if err := tx.Bucket(queryConversionOrderBucket).Put(queryConversionOrderKey(writtenAt, key), key); err != nil {
+			return err
+		}
+
+		return evictOverCap(tx, b.maxEntries)
+	})
+}
+
+// queryConversionOrderKey derives queryConversionOrderBucket's key for an
+// entry from its writtenAt time and its queryConversionBucket key.
+func queryConversionOrderKey(writtenAt time.Time, key []byte) []byte {
+	orderKey := make([]byte, 8+len(key))
+	binary.BigEndian.PutUint64(orderKey, uint64(writtenAt.UnixNano()))
+	copy(orderKey[8:], key)
+	return orderKey
+}
+
+// deleteQueryConversionEntry removes key (written at writtenAt) from both
+// queryConversionBucket and its queryConversionOrderBucket index entry.
+func deleteQueryConversionEntry(tx *bolt.Tx, key []byte, writtenAt time.Time) error {
+	if err := tx.Bucket(queryConversionBucket).Delete(key); err != nil {
+		return err
+	}
+	return tx.Bucket(queryConversionOrderBucket).Delete(queryConversionOrderKey(writtenAt, key))
+}
+
+// evictOverCap removes the least-recently-written entries from
+// queryConversionBucket until it holds at most maxEntries; maxEntries <= 0
+// leaves it unbounded. queryConversionOrderBucket's keys sort oldest-first,
+// so the entries to evict are always the ones at the front of its cursor.
+func evictOverCap(tx *bolt.Tx, maxEntries int) error {
+	if maxEntries <= 0 {
+		return nil
+	}
+
+	mainBucket := tx.Bucket(queryConversionBucket)
+	orderBucket := tx.Bucket(queryConversionOrderBucket)
+
+	cursor := orderBucket.Cursor()
+	for n := mainBucket.Stats().KeyN; n > maxEntries; n-- {
+		orderKey, key := cursor.First()
+		if orderKey == nil {
+			break
+		}
+		if err := mainBucket.Delete(key); err != nil {
+			return err
+		}
+		if err := orderBucket.Delete(orderKey); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// queryConversionEntry is the value stored in the backend for each key: the
+// compiled query plus the time it was written, so Get can enforce TTL.
+type queryConversionEntry struct {
+	query     idx.Query
+	writtenAt time.Time
+}
+
+// encodeQueryConversionEntry serializes a queryConversionEntry as an
+// 8-byte little-endian UnixNano timestamp followed by the query's stable
+// protobuf encoding, so entries persisted by one binary version can be
+// read back by another as long as the schema is compatible.
+func encodeQueryConversionEntry(e queryConversionEntry) ([]byte, error) {
+	queryBytes, err := e.query.ToProto().Marshal()
+	if err != nil {
+		return nil, fmt.Errorf("query conversion backend: error marshaling query: %v", err)
+	}
+
+	buf := make([]byte, 8+len(queryBytes))
+	binary.LittleEndian.PutUint64(buf, uint64(e.writtenAt.UnixNano()))
+	copy(buf[8:], queryBytes)
+	return buf, nil
+}
+
+func decodeQueryConversionEntry(v []byte) (queryConversionEntry, error) {
+	if len(v) < 8 {
+		return queryConversionEntry{}, fmt.Errorf("query conversion backend: corrupt entry")
+	}
+
+	writtenAt := time.Unix(0, int64(binary.LittleEndian.Uint64(v[:8])))
+
+	var pb querypb.Query
+	if err := pb.Unmarshal(v[8:]); err != nil {
+		return queryConversionEntry{}, fmt.Errorf("query conversion backend: error unmarshaling query: %v", err)
+	}
+
+	q, err := idx.NewQueryFromProto(pb)
+	if err != nil {
+		return queryConversionEntry{}, fmt.Errorf("query conversion backend: error converting query from proto: %v", err)
+	}
+
+	return queryConversionEntry{query: q, writtenAt: writtenAt}, nil
+}